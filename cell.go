@@ -27,6 +27,8 @@ type Cell struct {
 	QueenAddress  string
 	Key           string
 	RootCertPath  string
+	ServerTiming  bool
+	Compress      bool
 
 	shouldStop bool
 
@@ -45,6 +47,7 @@ func (cell *Cell) Run() {
 	scribe.SetLogLevel(cell.logLevel)
 	cell.leash = client.NewLeash()
 	cell.leash.OnHTTP(cell.onHTTP)
+	cell.leash.SetCompression(cell.Compress)
 	cell.store = store.New(cell.DataDirectory)
 
 	// run setup callback
@@ -86,6 +89,20 @@ func (cell *Cell) SetCacheMaxAge(maxAge time.Duration) {
 	cell.store.SetCacheMaxAge(maxAge)
 }
 
+/* SetCacheLimit sets the maximum amount of memory, in bytes, that registered
+ * files and resources may use to cache data. Zero means there is no limit.
+ */
+func (cell *Cell) SetCacheLimit(limit int64) {
+	cell.store.SetCacheLimit(limit)
+}
+
+/* CacheSize returns the amount of memory, in bytes, that registered files and
+ * resources are currently using to cache data.
+ */
+func (cell *Cell) CacheSize() (size int64) {
+	return cell.store.Size()
+}
+
 /* RegisterFile registers a file located at the filepath on the specific url
  * path.
  */
@@ -100,16 +117,56 @@ func (cell *Cell) RegisterFile(
 }
 
 /* RegisterDir registers a directory located at the directory path on the
- * specific url path.
+ * specific url path. If store.PreloadAll is passed as an option, the files in
+ * the directory are loaded into memory in the background.
  */
 func (cell *Cell) RegisterDir(
 	dirPath string,
 	webPath string,
 	active bool,
+	options ...store.DirOption,
+) (
+	err error,
+) {
+	return cell.store.RegisterDir(dirPath, webPath, active, options...)
+}
+
+/* RegisterResource registers a custom resource on the specific url path.
+ */
+func (cell *Cell) RegisterResource(
+	webPath string,
+	resource store.Resource,
+) (
+	err error,
+) {
+	return cell.store.RegisterResource(webPath, resource)
+}
+
+/* RegisterDirResource registers a custom resource on the specific url path,
+ * treating it like a directory.
+ */
+func (cell *Cell) RegisterDirResource(
+	webPath string,
+	resource store.Resource,
 ) (
 	err error,
 ) {
-	return cell.store.RegisterDir(dirPath, webPath, active)
+	return cell.store.RegisterDirResource(webPath, resource)
+}
+
+/* Invalidate finds the resource registered at the specified url path, and
+ * discards any data it has cached. The path can be a registered directory, or
+ * a file inside of one.
+ */
+func (cell *Cell) Invalidate(webPath string) (err error) {
+	return cell.store.Invalidate(webPath)
+}
+
+/* Preload loads the files registered at the specified url paths into memory in
+ * the background, so that the first request for them is served quickly.
+ */
+func (cell *Cell) Preload(webPaths ...string) {
+	cell.store.Preload(webPaths...)
 }
 
 /* UnregisterFile finds the file registered at the specified url path and
@@ -127,6 +184,19 @@ func (cell *Cell) UnregisterDir(webPath string) (err error) {
 }
 
 func (cell *Cell) onHTTP(band *client.Band, head *protocol.FrameHTTPReqHead) {
+	timing := newTiming(head.Headers)
+	band.OnWriteHead(timing.onWriteHead(cell.ServerTiming))
+	defer func() {
+		band.OnWriteHead(nil)
+		timing.End = time.Now()
+		scribe.PrintInfo(
+			scribe.LogLevelDebug,
+			"request for \""+head.Host+head.Path+"\"",
+			"took", timing.Total(),
+			"(queued", timing.Queued(),
+			"first byte", timing.TimeToFirstByte(), ")")
+	}()
+
 	handled, err := cell.store.TryHandle(band, head)
 	// TODO: respond with error
 	if err != nil {
@@ -138,14 +208,17 @@ func (cell *Cell) onHTTP(band *client.Band, head *protocol.FrameHTTPReqHead) {
 	}
 
 	response := &HTTPResponse{
-		band: band,
+		Timing: timing,
+		band:   band,
 	}
 
 	request := &HTTPRequest{
-		band: band,
-		Head: head,
+		Timing: timing,
+		band:   band,
+		Head:   head,
 	}
 
+	timing.HandlerStart = time.Now()
 	cell.OnHTTP(response, request)
 }
 
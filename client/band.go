@@ -1,6 +1,8 @@
 package client
 
 import (
+	"bytes"
+	"compress/gzip"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -20,6 +22,17 @@ type Band struct {
 	isGarbage bool
 	callback  func(*Band, protocol.FrameKind, []byte)
 
+	compressed        bool
+	compressing       bool
+	requestCompressed bool
+	gzipWriter        *gzip.Writer
+	gzipReader        *gzip.Reader
+	gzipBuffer        bytes.Buffer
+	maxBodySize       int
+	bodyRead          int
+
+	onWriteHead func(headers map[string][]string) map[string][]string
+
 	stopNotify chan int
 }
 
@@ -29,6 +42,7 @@ func spawnBand(
 	key string,
 	callback func(*Band, protocol.FrameKind, []byte),
 	tlsConf *tls.Config,
+	compress bool,
 ) (
 	band *Band,
 	err error,
@@ -46,11 +60,17 @@ func spawnBand(
 	writer := fsock.NewWriter(conn)
 
 	scribe.PrintProgress(scribe.LogLevelDebug, "requesting band status")
-	_, err = protocol.WriteMarshalFrame(writer, &protocol.FrameIAm{
-		ConnKind: protocol.ConnKindBand,
-		Uuid:     uuid,
-		Key:      key,
-	})
+	iAm := &frameIAmCompress{
+		FrameIAm: protocol.FrameIAm{
+			ConnKind: protocol.ConnKindBand,
+			Uuid:     uuid,
+			Key:      key,
+		},
+	}
+	if compress {
+		iAm.Compression = compressionGzip
+	}
+	_, err = protocol.WriteMarshalFrame(writer, iAm)
 	if err != nil {
 		conn.Close()
 		return nil, err
@@ -67,7 +87,7 @@ func spawnBand(
 			"server sent strange response:", kind))
 	}
 
-	frame := protocol.FrameAccept{}
+	frame := frameAcceptCompress{}
 	err = json.Unmarshal(data, &frame)
 	if err != nil {
 		conn.Close()
@@ -76,10 +96,15 @@ func spawnBand(
 	scribe.PrintDone(scribe.LogLevelDebug, "band accepted")
 
 	band = &Band{
-		conn:     conn,
-		reader:   reader,
-		writer:   writer,
-		callback: callback,
+		conn:       conn,
+		reader:     reader,
+		writer:     writer,
+		callback:   callback,
+		compressed: frame.Compression == compressionGzip,
+	}
+	if band.compressed {
+		scribe.PrintInfo(
+			scribe.LogLevelDebug, "band payloads will be compressed")
 	}
 
 	go band.listen()
@@ -171,8 +196,22 @@ func (band *Band) WriteMarshalFrame(frame protocol.Frame) (nn int, err error) {
 	return
 }
 
+/* OnWriteHead sets a function that is called whenever HTTP header information
+ * is written on the band, no matter what writes it. The function may return a
+ * modified set of headers, and must not modify the ones it was given. Since a
+ * band serves one request at a time, this is meant to be set at the start of a
+ * request and cleared with nil at the end of it.
+ */
+func (band *Band) OnWriteHead(
+	callback func(headers map[string][]string) map[string][]string,
+) {
+	band.onWriteHead = callback
+}
+
 /* WriteHTTPHead writes HTTP header information. It should only be called once
- * when serving an HTTP response.
+ * when serving an HTTP response. If compression was negotiated with the queen
+ * and the content type is worth compressing, the response body will be sent as
+ * a single gzip stream.
  */
 func (band *Band) WriteHTTPHead(
 	code int,
@@ -181,18 +220,41 @@ func (band *Band) WriteHTTPHead(
 	nn int,
 	err error,
 ) {
+	if band.onWriteHead != nil {
+		headers = band.onWriteHead(headers)
+	}
 	if headers == nil {
 		headers = make(map[string][]string)
 	}
+
+	if band.compressed && compressible(code, headers) {
+		// copy the headers so that maps shared between responses
+		// aren't modified
+		withEncoding := make(map[string][]string, len(headers)+1)
+		for key, values := range headers {
+			withEncoding[key] = values
+		}
+		withEncoding[bandEncodingHeader] = []string{compressionGzip}
+		headers = withEncoding
+		band.startCompressing()
+	}
+
 	return band.WriteMarshalFrame(&protocol.FrameHTTPResHead{
 		StatusCode: code,
 		Headers:    headers,
 	})
 }
 
-/* WriteHTTPBody writes a chunk of the response body.
+/* WriteHTTPBody writes a chunk of the response body. If the response is being
+ * compressed, the chunk is added to the gzip stream before being sent.
  */
 func (band *Band) WriteHTTPBody(data []byte) (nn int, err error) {
+	if band.compressing {
+		data, err = band.compress(data)
+		if err != nil {
+			return 0, err
+		}
+	}
 	return band.writer.WriteFrame(
 		append(
 			[]byte{byte(protocol.FrameKindHTTPResBody)},
@@ -205,15 +267,34 @@ func (band *Band) WriteHTTPBody(data []byte) (nn int, err error) {
  * automatically by the internal callback set by the leash.
  */
 func (band *Band) writeHTTPEnd() (nn int, err error) {
+	if band.compressing {
+		data, err := band.finishCompressing()
+		if err != nil {
+			return 0, err
+		}
+		_, err = band.writer.WriteFrame(
+			append(
+				[]byte{byte(protocol.FrameKindHTTPResBody)},
+				data...,
+			),
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	return band.writer.WriteFrame(
 		[]byte{byte(protocol.FrameKindHTTPResEnd)},
 	)
 }
 
 /* AskForHTTPBody requests the http body data from the queen. The queen will
- * return at maximum the amount of data specified with maxSize.
+ * return at maximum the amount of data specified with maxSize. If the body is
+ * compressed, the queen applies maxSize to the compressed data it sends, and
+ * the cell applies it again to the data once it is decompressed.
  */
 func (band *Band) AskForHTTPBody(maxSize int) (nn int, err error) {
+	band.maxBodySize = maxSize
 	return band.WriteMarshalFrame(&protocol.FrameHTTPResWant{
 		MaxSize: maxSize,
 	})
@@ -221,9 +302,23 @@ func (band *Band) AskForHTTPBody(maxSize int) (nn int, err error) {
 
 /* ReadHTTPBody reads a chunk of the request body. This function returns true
  * for getNext if the chunk was successfully read, and false if it encountered
- * an error or the request ended.
+ * an error or the request ended. If the queen compressed the request body, it
+ * is decompressed transparently.
  */
 func (band *Band) ReadHTTPBody() (getNext bool, data []byte, err error) {
+	if band.requestCompressed {
+		return band.readCompressedBody()
+	}
+	return band.readHTTPBodyFrame()
+}
+
+/* readHTTPBodyFrame reads the raw payload of a single request body frame.
+ */
+func (band *Band) readHTTPBodyFrame() (
+	getNext bool,
+	data []byte,
+	err error,
+) {
 	getNext = false
 
 	kind, data, err := band.ReadParseFrame()
@@ -0,0 +1,246 @@
+package client
+
+import (
+	"compress/gzip"
+	"errors"
+	"github.com/hlhv/protocol"
+	"io"
+	"strings"
+)
+
+/* compressionGzip is the name of the gzip compression scheme, as it is sent to
+ * the queen when negotiating compression.
+ */
+const compressionGzip = "gzip"
+
+/* bandEncodingHeader marks a request or response whose body is sent over the
+ * band as a single gzip stream spanning all of its body frames. The cell adds
+ * it to the head of compressed responses, and the queen adds it to the head of
+ * compressed requests. The receiving side removes it before passing the head
+ * on. Bodies without it are sent as-is.
+ */
+const bandEncodingHeader = "hlhv-band-encoding"
+
+/* decompressChunkSize is the maximum amount of decompressed data returned by a
+ * single read of a compressed request body.
+ */
+const decompressChunkSize = 8192
+
+/* incompressibleTypes lists content type prefixes for data that is usually
+ * already compressed, and would only get bigger if it was compressed again.
+ */
+var incompressibleTypes = []string{
+	"image/png",
+	"image/jpeg",
+	"image/gif",
+	"image/webp",
+	"image/avif",
+	"audio/",
+	"video/",
+	"font/woff",
+	"font/woff2",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/zstd",
+	"application/pdf",
+}
+
+/* errBodyTooLarge is returned when a decompressed request body is larger than
+ * the maximum size that was asked for.
+ */
+var errBodyTooLarge = errors.New("request body exceeds maximum size")
+
+/* frameIAmCompress extends FrameIAm with a field for requesting compression of
+ * frame payloads. Queens that don't know about compression will ignore the
+ * extra field.
+ */
+type frameIAmCompress struct {
+	protocol.FrameIAm
+	Compression string `json:"compression,omitempty"`
+}
+
+/* frameAcceptCompress extends FrameAccept with a field the queen uses to
+ * confirm which compression scheme it agreed to. If it is empty, the queen
+ * either doesn't support compression or declined it, and payloads are sent
+ * as-is.
+ */
+type frameAcceptCompress struct {
+	protocol.FrameAccept
+	Compression string `json:"compression,omitempty"`
+}
+
+/* compressible determines whether a response with the given status code and
+ * headers is worth compressing, based on its content type. Responses that
+ * already have a content encoding, or that can't have a body, are never
+ * compressed.
+ */
+func compressible(
+	code int,
+	headers map[string][]string,
+) (
+	worthIt bool,
+) {
+	if code < 200 || code == 204 || code == 304 {
+		return false
+	}
+
+	contentType := ""
+	for key, values := range headers {
+		if strings.EqualFold(key, "content-encoding") {
+			return false
+		}
+		if strings.EqualFold(key, "content-type") && len(values) > 0 {
+			contentType = strings.ToLower(values[0])
+		}
+	}
+
+	for _, prefix := range incompressibleTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+/* startCompressing begins a gzip stream for the current response. The gzip
+ * writer is kept around and reset for each response so that it doesn't need to
+ * be allocated every time.
+ */
+func (band *Band) startCompressing() {
+	band.gzipBuffer.Reset()
+	if band.gzipWriter == nil {
+		band.gzipWriter = gzip.NewWriter(&band.gzipBuffer)
+	} else {
+		band.gzipWriter.Reset(&band.gzipBuffer)
+	}
+	band.compressing = true
+}
+
+/* compress adds a chunk of the response body to the gzip stream, and flushes
+ * it so that the chunk can be sent right away instead of waiting for the rest
+ * of the response.
+ */
+func (band *Band) compress(data []byte) (compressed []byte, err error) {
+	band.gzipBuffer.Reset()
+	_, err = band.gzipWriter.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = band.gzipWriter.Flush()
+	if err != nil {
+		return nil, err
+	}
+	return band.gzipBuffer.Bytes(), nil
+}
+
+/* finishCompressing ends the gzip stream for the current response, and
+ * returns the data needed to terminate it.
+ */
+func (band *Band) finishCompressing() (compressed []byte, err error) {
+	band.compressing = false
+	band.gzipBuffer.Reset()
+	err = band.gzipWriter.Close()
+	if err != nil {
+		return nil, err
+	}
+	return band.gzipBuffer.Bytes(), nil
+}
+
+/* beginRequest prepares the band for a new request. If the queen marked the
+ * request body as compressed, the marker header is removed so that handlers
+ * don't see it, and the body will be decompressed as it is read.
+ */
+func (band *Band) beginRequest(head *protocol.FrameHTTPReqHead) {
+	band.requestCompressed = false
+	band.gzipReader = nil
+	band.maxBodySize = 0
+	band.bodyRead = 0
+
+	for key, values := range head.Headers {
+		if strings.EqualFold(key, bandEncodingHeader) {
+			delete(head.Headers, key)
+			band.requestCompressed = len(values) > 0 &&
+				values[0] == compressionGzip
+		}
+	}
+}
+
+/* bodyFrameReader reads the raw payloads of request body frames as one
+ * continuous stream, so that a gzip stream spanning several frames can be
+ * decompressed. It returns io.EOF once the end of the request is reached.
+ */
+type bodyFrameReader struct {
+	band    *Band
+	pending []byte
+	ended   bool
+}
+
+/* Read reads data from the request body frames, reading a new frame from the
+ * band whenever it runs out.
+ */
+func (reader *bodyFrameReader) Read(buffer []byte) (nn int, err error) {
+	for len(reader.pending) == 0 {
+		if reader.ended {
+			return 0, io.EOF
+		}
+
+		getNext, data, err := reader.band.readHTTPBodyFrame()
+		if err != nil {
+			return 0, err
+		}
+		reader.pending = data
+		reader.ended = !getNext
+	}
+
+	nn = copy(buffer, reader.pending)
+	reader.pending = reader.pending[nn:]
+	return nn, nil
+}
+
+/* readCompressedBody reads and decompresses a chunk of a compressed request
+ * body. It returns an error if the decompressed body would exceed the maximum
+ * size that was asked for.
+ */
+func (band *Band) readCompressedBody() (getNext bool, data []byte, err error) {
+	if band.gzipReader == nil {
+		band.gzipReader, err = gzip.NewReader(&bodyFrameReader{band: band})
+		if err == io.EOF {
+			// the body was empty
+			band.requestCompressed = false
+			return false, nil, nil
+		}
+		if err != nil {
+			return false, nil, err
+		}
+	}
+
+	// read one byte past the limit so we can tell if it was exceeded
+	remaining := band.maxBodySize - band.bodyRead
+	if remaining < 0 {
+		remaining = 0
+	}
+	limit := decompressChunkSize
+	if remaining+1 < limit {
+		limit = remaining + 1
+	}
+
+	data = make([]byte, limit)
+	nn, err := io.ReadAtLeast(band.gzipReader, data, 1)
+	if err == io.EOF {
+		band.requestCompressed = false
+		band.gzipReader = nil
+		return false, nil, nil
+	}
+	if err != nil {
+		return false, nil, err
+	}
+	if nn > remaining {
+		return false, nil, errBodyTooLarge
+	}
+
+	band.bodyRead += nn
+	return true, data[:nn], nil
+}
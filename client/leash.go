@@ -33,8 +33,9 @@ type Leash struct {
 	listening  bool
 	stopNotify chan int
 
-	handles leashHandles
-	tlsConf *tls.Config
+	handles  leashHandles
+	tlsConf  *tls.Config
+	compress bool
 }
 
 /* leashHandles stores event handler functions for a leash.
@@ -63,6 +64,15 @@ func NewLeash() (leash *Leash) {
 	}
 }
 
+/* SetCompression sets whether the leash should ask the queen to compress frame
+ * payloads sent over its bands. This only takes effect for bands created after
+ * it is called, and only if the queen supports it. Compression is useful when
+ * the cell and the queen are on different machines.
+ */
+func (leash *Leash) SetCompression(compress bool) {
+	leash.compress = compress
+}
+
 /* Dial connects the leash to a server. This function is only useful in some
  * cases, Ensure is usually a better option.
  */
@@ -201,6 +211,7 @@ func (leash *Leash) NewBand() (err error) {
 		leash.key,
 		leash.handleBandFrame,
 		leash.tlsConf,
+		leash.compress,
 	)
 
 	leash.bandsMutex.Lock()
@@ -293,6 +304,7 @@ func (leash *Leash) handleBandFrame(
 			scribe.LogLevelNormal,
 			"request for \""+frame.Host+frame.Path+"\"",
 			"by", frame.RemoteAddr)
+		band.beginRequest(frame)
 		leash.handles.onHTTP(band, frame)
 		band.writeHTTPEnd()
 		break
@@ -10,6 +10,7 @@ import (
  */
 type HTTPRequest struct {
 	Head         *protocol.FrameHTTPReqHead
+	Timing       *Timing
 	band         *client.Band
 	askedForBody bool
 	maxBodySize  int
@@ -23,6 +24,13 @@ func (request *HTTPRequest) SetMaxBodySize(maxSize int) {
 	request.maxBodySize = maxSize
 }
 
+/* GetHeader returns the first value of the request header matching name,
+ * ignoring case. If the header isn't present, it returns an empty string.
+ */
+func (request *HTTPRequest) GetHeader(name string) (value string) {
+	return getHeader(request.Head.Headers, name)
+}
+
 /* ensureBodyRequested determines if the body needs to be asked for from the
  * queen. If it does, it ensures that the maximum body size is set, and then
  * sends the request.
@@ -2,17 +2,20 @@ package cell
 
 import (
 	"github.com/hlhv/cell/client"
+	"time"
 )
 
 /* HTTPResponse stores information about an HTTP response, and has function for
  * writing its response body
  */
 type HTTPResponse struct {
-	band *client.Band
+	Timing *Timing
+	band   *client.Band
 }
 
 /* WriteHead writes HTTP header information. It should only be called once when
- * serving an HTTP response. Passing nil for headers will send no headers.
+ * serving an HTTP response. Passing nil for headers will send no headers. If
+ * the cell has ServerTiming enabled, a Server-Timing header is added.
  */
 func (response *HTTPResponse) WriteHead(
 	code int,
@@ -27,6 +30,16 @@ func (response *HTTPResponse) WriteHead(
 /* WriteBody writes a chunk of the response body.
  */
 func (response *HTTPResponse) WriteBody(data []byte) (err error) {
+	response.markFirstByte()
 	_, err = response.band.WriteHTTPBody(data)
 	return
 }
+
+/* markFirstByte records when the response started being written, if it hasn't
+ * been recorded already.
+ */
+func (response *HTTPResponse) markFirstByte() {
+	if response.Timing != nil && response.Timing.FirstByte.IsZero() {
+		response.Timing.FirstByte = time.Now()
+	}
+}
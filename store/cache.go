@@ -0,0 +1,164 @@
+package store
+
+import (
+	"github.com/hlhv/scribe"
+	"sort"
+	"strings"
+	"time"
+)
+
+/* cacheEntry is a resource that can be invalidated to free memory, along with
+ * the url path it is known by.
+ */
+type cacheEntry struct {
+	key      string
+	resource Resource
+	lastUsed time.Time
+}
+
+/* SetCacheLimit sets the maximum amount of memory, in bytes, that the resources
+ * in the store may use to cache data. When a request causes the limit to be
+ * exceeded, the least recently requested resources are invalidated until it
+ * isn't. Preloading a resource counts as requesting it, and preloading stops
+ * once the limit is reached. A limit of zero, which is the default, means there
+ * is no limit.
+ */
+func (store *Store) SetCacheLimit(limit int64) {
+	store.usageLock.Lock()
+	store.cacheLimit = limit
+	store.usageLock.Unlock()
+}
+
+/* markUsed records that the resource known by key was just requested, and then
+ * makes sure the cache limit is respected.
+ */
+func (store *Store) markUsed(key string) {
+	store.usageLock.Lock()
+	defer store.usageLock.Unlock()
+
+	store.usage[key] = time.Now()
+	if store.cacheLimit <= 0 {
+		return
+	}
+
+	size := store.Size()
+	if size <= store.cacheLimit {
+		return
+	}
+
+	scribe.PrintProgress(
+		scribe.LogLevelDebug,
+		"cache is over its limit, freeing memory")
+
+	entries := store.cacheEntries()
+	sort.Slice(entries, func(left, right int) bool {
+		return entries[left].lastUsed.Before(entries[right].lastUsed)
+	})
+
+	for _, entry := range entries {
+		if size <= store.cacheLimit {
+			break
+		}
+		// don't throw out what was just loaded
+		if entry.key == key {
+			continue
+		}
+
+		entrySize := entry.resource.Size()
+		if entrySize == 0 {
+			continue
+		}
+		// files that are busy loading are skipped rather than waited
+		// for, so that this request isn't held up by a slow disk
+		file, isFile := entry.resource.(*LazyFile)
+		if isFile {
+			if !file.tryInvalidate() {
+				continue
+			}
+		} else {
+			entry.resource.Invalidate()
+		}
+		delete(store.usage, entry.key)
+		size -= entrySize
+	}
+
+	scribe.PrintDone(scribe.LogLevelDebug, "cache is", size, "bytes")
+}
+
+/* markPreloaded records that the resource known by key was preloaded. This
+ * counts as a use, unless the resource has already been requested.
+ */
+func (store *Store) markPreloaded(key string) {
+	store.usageLock.Lock()
+	defer store.usageLock.Unlock()
+
+	_, used := store.usage[key]
+	if !used {
+		store.usage[key] = time.Now()
+	}
+}
+
+/* cacheFull returns whether the store has a cache limit and has reached it.
+ */
+func (store *Store) cacheFull() (full bool) {
+	store.usageLock.Lock()
+	limit := store.cacheLimit
+	store.usageLock.Unlock()
+	return limit > 0 && store.Size() >= limit
+}
+
+/* cacheEntries lists every resource that could be invalidated to free memory.
+ * Files inside of a LazyDir are listed on their own, so that they can be
+ * invalidated separately. The usage lock must be held while this is called.
+ */
+func (store *Store) cacheEntries() (entries []cacheEntry) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	for key, resource := range store.files {
+		entries = append(entries, cacheEntry{
+			key:      key,
+			resource: resource,
+			lastUsed: store.usage[key],
+		})
+	}
+
+	for key, resource := range store.dirs {
+		lazyDir, isLazyDir := resource.(*LazyDir)
+		if !isLazyDir {
+			entries = append(entries, cacheEntry{
+				key:      key,
+				resource: resource,
+				lastUsed: store.usage[key],
+			})
+			continue
+		}
+
+		for fileKey, file := range lazyDir.files() {
+			entries = append(entries, cacheEntry{
+				key:      fileKey,
+				resource: file,
+				lastUsed: store.usage[fileKey],
+			})
+		}
+	}
+	return entries
+}
+
+/* forgetUsage removes usage records for a url path that was unregistered. If
+ * isDir is true, records for everything inside of it are removed as well.
+ */
+func (store *Store) forgetUsage(webPath string, isDir bool) {
+	store.usageLock.Lock()
+	defer store.usageLock.Unlock()
+
+	delete(store.usage, webPath)
+	if !isDir {
+		return
+	}
+	for key := range store.usage {
+		if strings.HasPrefix(key, webPath) {
+			delete(store.usage, key)
+		}
+	}
+}
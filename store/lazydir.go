@@ -1,10 +1,14 @@
 package store
 
 import (
+	"github.com/hlhv/cell/client"
+	"github.com/hlhv/protocol"
 	"github.com/hlhv/scribe"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 )
 
 /* LazyDir is a struct which manages a directory of LazyFiles.
@@ -14,7 +18,14 @@ type LazyDir struct {
 	WebPath string
 	Active  bool
 
-	items map[string]*LazyFile
+	items  map[string]*LazyFile
+	listed bool
+	// lock guards items and listed, which are changed while requests are
+	// being handled.
+	lock sync.Mutex
+
+	// counter is passed on to the files in the directory, see LazyFile.
+	counter *int64
 }
 
 /* Find returns the LazyFile matching webPath, if there is one in the LazyDir.
@@ -22,13 +33,65 @@ type LazyDir struct {
  */
 func (lazyDir *LazyDir) Find(webPath string) (file *LazyFile, err error) {
 	scribe.PrintProgress(scribe.LogLevelDebug, "finding "+webPath)
+	lazyDir.lock.Lock()
+	defer lazyDir.lock.Unlock()
 	if lazyDir.Active {
 		return lazyDir.findActive(webPath)
 	} else {
 		return lazyDir.findLazy(webPath)
 	}
-	scribe.PrintProgress(scribe.LogLevelDebug, "found "+webPath)
-	return
+}
+
+/* Send finds the file matching the request path and sends it. If there is no
+ * such file, it returns ErrNotFound.
+ */
+func (lazyDir *LazyDir) Send(
+	band *client.Band,
+	head *protocol.FrameHTTPReqHead,
+	maxAge time.Duration,
+) (
+	err error,
+) {
+	file, err := lazyDir.Find(head.Path)
+	if err != nil {
+		return err
+	}
+	if file == nil {
+		return ErrNotFound
+	}
+	return file.Send(band, head, maxAge)
+}
+
+/* Invalidate discards the loaded contents of every file in the directory.
+ */
+func (lazyDir *LazyDir) Invalidate() {
+	for _, file := range lazyDir.files() {
+		file.Invalidate()
+	}
+}
+
+/* Size returns the combined size of every file in the directory that is loaded
+ * into memory.
+ */
+func (lazyDir *LazyDir) Size() (size int64) {
+	for _, file := range lazyDir.files() {
+		size += file.Size()
+	}
+	return size
+}
+
+/* files returns a copy of the map of files in the directory that have entries,
+ * so that they can be iterated over without holding the lock.
+ */
+func (lazyDir *LazyDir) files() (files map[string]*LazyFile) {
+	lazyDir.lock.Lock()
+	defer lazyDir.lock.Unlock()
+
+	files = make(map[string]*LazyFile, len(lazyDir.items))
+	for webPath, file := range lazyDir.items {
+		files[webPath] = file
+	}
+	return files
 }
 
 /* findLazy first checks if its contents needed to be loaded in. If they do, it
@@ -41,32 +104,84 @@ func (lazyDir *LazyDir) findLazy(
 	file *LazyFile,
 	err error,
 ) {
-	if lazyDir.items == nil {
-		scribe.PrintProgress(
-			scribe.LogLevelDebug, "loading dir item list")
-		lazyDir.items = make(map[string]*LazyFile)
-
-		directory, err := ioutil.ReadDir(lazyDir.DirPath)
+	if !lazyDir.listed {
+		err = lazyDir.loadItems()
 		if err != nil {
 			return nil, err
 		}
-
-		for _, file := range directory {
-			if file.IsDir() {
-				continue
-			}
-			item := &LazyFile{
-				FilePath: lazyDir.DirPath + file.Name(),
-			}
-			lazyDir.items[lazyDir.WebPath+file.Name()] = item
-		}
-		scribe.PrintDone(scribe.LogLevelDebug, "loaded")
 	}
 
 	file, _ = lazyDir.items[webPath]
 	return file, nil
 }
 
+/* loadItems reads the directory and creates an entry for each file inside of
+ * it. Entries that already exist are kept as they are. The directory must be
+ * locked while this is called.
+ */
+func (lazyDir *LazyDir) loadItems() (err error) {
+	scribe.PrintProgress(scribe.LogLevelDebug, "loading dir item list")
+	if lazyDir.items == nil {
+		lazyDir.items = make(map[string]*LazyFile)
+	}
+
+	directory, err := ioutil.ReadDir(lazyDir.DirPath)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range directory {
+		if file.IsDir() {
+			continue
+		}
+		webPath := lazyDir.WebPath + file.Name()
+		_, exists := lazyDir.items[webPath]
+		if exists {
+			continue
+		}
+		lazyDir.items[webPath] = &LazyFile{
+			FilePath:   lazyDir.DirPath + file.Name(),
+			AutoReload: lazyDir.Active,
+			counter:    lazyDir.counter,
+		}
+	}
+	lazyDir.listed = true
+	scribe.PrintDone(scribe.LogLevelDebug, "loaded")
+	return nil
+}
+
+/* Preload loads the list of files in the directory, and then loads each file
+ * into memory in the background, a few at a time. The list is loaded before
+ * this function returns.
+ */
+func (lazyDir *LazyDir) Preload() (err error) {
+	jobs, err := lazyDir.preloadJobs()
+	if err != nil {
+		return err
+	}
+	preloadInBackground(jobs, nil)
+	return nil
+}
+
+/* preloadJobs loads the list of files in the directory, and returns a job for
+ * preloading each one.
+ */
+func (lazyDir *LazyDir) preloadJobs() (jobs []preloadJob, err error) {
+	lazyDir.lock.Lock()
+	err = lazyDir.loadItems()
+	lazyDir.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	files := lazyDir.files()
+	jobs = make([]preloadJob, 0, len(files))
+	for webPath, file := range files {
+		jobs = append(jobs, preloadJob{webPath, file})
+	}
+	return jobs, nil
+}
+
 /* findActive looks fot the file matching webPath by getting its basename and
  * seeing if a file with that basename exists within itself. If it doesn't, it
  * will return nil. This function dynamically updates the items map if it finds
@@ -85,7 +200,13 @@ func (lazyDir *LazyDir) findActive(
 		scribe.PrintProgress(
 			scribe.LogLevelDebug,
 			"file doesn't exist, removing entry if it is there")
-		delete(lazyDir.items, webPath)
+		// invalidate the entry first, so that its memory is no longer
+		// counted by the store
+		removed, exists := lazyDir.items[webPath]
+		if exists {
+			removed.Invalidate()
+			delete(lazyDir.items, webPath)
+		}
 		return nil, nil
 	}
 
@@ -101,6 +222,7 @@ func (lazyDir *LazyDir) findActive(
 	file = &LazyFile{
 		FilePath:   filePath,
 		AutoReload: true,
+		counter:    lazyDir.counter,
 	}
 	lazyDir.items[webPath] = file
 	return file, nil
@@ -8,8 +8,9 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,13 +32,25 @@ type LazyFile struct {
 	chunks    []fileChunk
 	timestamp time.Time
 
-	totalSize       int64
-	totalSizeString string
+	totalSize int64
+
+	// loaded is the amount of bytes currently held in memory. It is
+	// accessed atomically so that it can be read without waiting for the
+	// file to finish loading. Changes to it are added to counter, which
+	// is the running total of the store the file belongs to.
+	loaded  int64
+	counter *int64
+
+	// lock prevents the file from being loaded by two goroutines at once,
+	// for example when it is being preloaded while a request comes in.
+	lock sync.Mutex
 }
 
 type fileChunk []byte
 
-/* Send sends the file along with a content-type header.
+/* Send sends the file along with a content-type header. The file is only
+ * locked while it is being loaded, so that requests for the same file don't
+ * have to wait for each other to finish sending.
  */
 func (item *LazyFile) Send(
 	band *client.Band,
@@ -47,30 +60,25 @@ func (item *LazyFile) Send(
 	err error,
 ) {
 	scribe.PrintProgress(scribe.LogLevelDebug, "sending file")
-	if item.AutoReload {
-		// check to see if file needs to be reloaded
-		newTimestamp, err := item.getCurrentTimestamp()
-		if err != nil {
-			return err
-		}
-
-		if newTimestamp.After(item.timestamp) {
-			item.timestamp = newTimestamp
-			item.chunks = nil
-		}
+	item.lock.Lock()
+	err = item.checkReload()
+	if err == nil && item.chunks == nil {
+		err = item.load()
 	}
-
-	if item.chunks == nil {
-		err = item.loadAndSend(band, head, maxAge)
+	chunks := item.chunks
+	mime := item.mime
+	totalSize := item.totalSize
+	item.lock.Unlock()
+	if err != nil {
 		return err
 	}
 
-	err = item.sendHeaders(band, maxAge)
+	err = SendHeaders(band, maxAge, mime, totalSize)
 	if err != nil {
 		return err
 	}
 
-	for _, chunk := range item.chunks {
+	for _, chunk := range chunks {
 		_, err = band.WriteHTTPBody(chunk)
 		if err != nil {
 			return err
@@ -81,28 +89,97 @@ func (item *LazyFile) Send(
 	return nil
 }
 
-/* sendHeaders creates builds and sends applicable HTTP headers.
+/* Preload loads the file into memory without sending it anywhere, so that the
+ * first request for it doesn't have to wait for it to be read from disk. If the
+ * file is already loaded and up to date, this does nothing.
  */
-func (item *LazyFile) sendHeaders(
-	band *client.Band,
-	maxAge time.Duration,
-) (
-	err error,
-) {
-	headers := map[string][]string{
-		"content-type":   {item.mime},
-		"content-length": {item.totalSizeString},
+func (item *LazyFile) Preload() (err error) {
+	scribe.PrintProgress(scribe.LogLevelDebug, "preloading "+item.FilePath)
+	item.lock.Lock()
+	defer item.lock.Unlock()
+
+	err = item.checkReload()
+	if err != nil {
+		return err
+	}
+	if item.chunks != nil {
+		return nil
 	}
 
-	if maxAge > 0 && item.mime != "text/html" {
-		headers["cache-control"] = []string{
-			"max-age=" +
-				strconv.Itoa(int(maxAge.Seconds())),
-		}
+	err = item.load()
+	if err != nil {
+		return err
+	}
+
+	scribe.PrintDone(scribe.LogLevelDebug, "preloaded "+item.FilePath)
+	return nil
+}
+
+/* Invalidate discards the loaded file contents, so that the file is read from
+ * disk again the next time it is sent.
+ */
+func (item *LazyFile) Invalidate() {
+	item.lock.Lock()
+	defer item.lock.Unlock()
+	item.unload()
+}
+
+/* tryInvalidate invalidates the file, unless it is currently being loaded. It
+ * returns whether the file was invalidated. This is used when freeing memory,
+ * so that a slow load doesn't hold up the request that is freeing it.
+ */
+func (item *LazyFile) tryInvalidate() (invalidated bool) {
+	if !item.lock.TryLock() {
+		return false
+	}
+	defer item.lock.Unlock()
+	item.unload()
+	return true
+}
+
+/* Size returns the size of the file if it is loaded into memory, and zero if it
+ * is not.
+ */
+func (item *LazyFile) Size() (size int64) {
+	return atomic.LoadInt64(&item.loaded)
+}
+
+/* unload discards the loaded file contents. The file must be locked while this
+ * is called.
+ */
+func (item *LazyFile) unload() {
+	item.chunks = nil
+	item.setLoaded(0)
+}
+
+/* setLoaded records how many bytes of the file are held in memory, updating the
+ * running total of the store it belongs to.
+ */
+func (item *LazyFile) setLoaded(loaded int64) {
+	previous := atomic.SwapInt64(&item.loaded, loaded)
+	if item.counter != nil {
+		atomic.AddInt64(item.counter, loaded-previous)
+	}
+}
+
+/* checkReload discards the loaded file contents if AutoReload is on and the
+ * file has been modified on disk since it was loaded.
+ */
+func (item *LazyFile) checkReload() (err error) {
+	if !item.AutoReload {
+		return nil
+	}
+
+	newTimestamp, err := item.getCurrentTimestamp()
+	if err != nil {
+		return err
 	}
 
-	_, err = band.WriteHTTPHead(200, headers)
-	return
+	if newTimestamp.After(item.timestamp) {
+		item.timestamp = newTimestamp
+		item.unload()
+	}
+	return nil
 }
 
 /* getCurrentTimestamp returns the current timestamp of the file on disk.
@@ -115,33 +192,22 @@ func (item *LazyFile) getCurrentTimestamp() (timestamp time.Time, err error) {
 	return fileInfo.ModTime(), nil
 }
 
-/* loadAndSend loads the file from disk while sending it in response to an http
- * request. This should be called when there is an http request for this file
- * but it has not been loaded yet.
+/* load reads the entire file from disk into memory. The file must be locked
+ * while this is called.
  */
-func (item *LazyFile) loadAndSend(
-	band *client.Band,
-	head *protocol.FrameHTTPReqHead,
-	maxAge time.Duration,
-) (
-	err error,
-) {
-	scribe.PrintProgress(scribe.LogLevelDebug, "loading and sending file")
+func (item *LazyFile) load() (err error) {
 	file, err := os.Open(item.FilePath)
-	defer file.Close()
 	if err != nil {
 		return err
 	}
+	defer file.Close()
 
-	// get file size
 	fileInformation, err := file.Stat()
 	if err != nil {
 		return err
 	}
-	item.totalSize = fileInformation.Size()
-	item.totalSizeString = strconv.FormatInt(item.totalSize, 10)
 
-	needMime := true
+	chunks := []fileChunk{}
 	for {
 		chunk := make([]byte, chunkSize)
 		bytesRead, err := io.ReadFull(file, chunk)
@@ -152,25 +218,17 @@ func (item *LazyFile) loadAndSend(
 			return err
 		}
 
-		if needMime {
-			needMime = false
-			item.mime = mimeSniff(item.FilePath, chunk)
-
-			err = item.sendHeaders(band, maxAge)
-			if err != nil {
-				return err
-			}
-		}
-
-		item.chunks = append(item.chunks, chunk)
-		band.WriteHTTPBody(chunk)
-
+		chunks = append(chunks, chunk)
 		if fileEnded {
 			break
 		}
 	}
 
-	scribe.PrintDone(scribe.LogLevelDebug, "file loaded and sent")
+	item.mime = mimeSniff(item.FilePath, chunks[0])
+	item.totalSize = fileInformation.Size()
+	item.timestamp = fileInformation.ModTime()
+	item.chunks = chunks
+	item.setLoaded(item.totalSize)
 	return nil
 }
 
@@ -0,0 +1,88 @@
+package store
+
+import (
+	"errors"
+	"github.com/hlhv/cell/client"
+	"github.com/hlhv/protocol"
+	"strconv"
+	"time"
+)
+
+/* ErrNotFound should be returned by the Send method of a Resource registered
+ * as a directory when it has nothing to serve at the requested path. The store
+ * will then report the request as unhandled, so that it can be handled
+ * elsewhere.
+ */
+var ErrNotFound = errors.New("resource not found")
+
+/* Resource is anything that can be served by a Store. LazyFile and LazyDir are
+ * both resources, but custom implementations can be registered as well, for
+ * example to serve content from a database or to generate it when it is
+ * requested.
+ */
+type Resource interface {
+	// Send responds to an HTTP request. maxAge is the max age the store
+	// has been configured to use for the cache-control header. The store
+	// does not write any headers itself, so Send must write its head with
+	// SendHeaders in order to get the same headers as files do.
+	Send(
+		band *client.Band,
+		head *protocol.FrameHTTPReqHead,
+		maxAge time.Duration,
+	) (
+		err error,
+	)
+
+	// Invalidate discards any cached data, so that it is loaded again the
+	// next time it is needed. The store calls this to free memory when
+	// its cache limit is exceeded.
+	Invalidate()
+
+	// Size returns the amount of data, in bytes, that the resource
+	// currently holds in memory. The store uses this to enforce its cache
+	// limit.
+	Size() (size int64)
+}
+
+/* Preloader can be implemented by a Resource that is able to load its data
+ * ahead of time. Resources that implement it can be used with Store.Preload.
+ */
+type Preloader interface {
+	Preload() (err error)
+}
+
+/* SendHeaders builds and sends the HTTP headers the store uses when serving a
+ * file: content-type, content-length, and cache-control based on maxAge. The
+ * store only applies these headers through this function, so custom resources
+ * must call it from Send, passing along the maxAge they were given, if they are
+ * to be cached the same way as files. If size is negative, the content-length
+ * header is left out.
+ */
+func SendHeaders(
+	band *client.Band,
+	maxAge time.Duration,
+	mime string,
+	size int64,
+) (
+	err error,
+) {
+	headers := map[string][]string{
+		"content-type": {mime},
+	}
+
+	if size >= 0 {
+		headers["content-length"] = []string{
+			strconv.FormatInt(size, 10),
+		}
+	}
+
+	if maxAge > 0 && mime != "text/html" {
+		headers["cache-control"] = []string{
+			"max-age=" +
+				strconv.Itoa(int(maxAge.Seconds())),
+		}
+	}
+
+	_, err = band.WriteHTTPHead(200, headers)
+	return
+}
@@ -6,22 +6,69 @@ import (
 	"github.com/hlhv/protocol"
 	"github.com/hlhv/scribe"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 /* Store is a simple resource manager for serving static file resources. Files
  * can be registered and unregistered dynamically, and are loaded lazily. It can
- * be combined with any other system for serving files and pages.
+ * be combined with any other system for serving files and pages. Custom
+ * resources can be registered alongside files and directories by implementing
+ * the Resource interface.
  */
-
-// TODO: store separate map containing registered LazyDirs, and do a separate
-// check after stripping the basename from the filepath, then if match send
-// original filepath to the matched LazyDir.
 type Store struct {
-	lazyFiles map[string]*LazyFile
-	lazyDirs  map[string]*LazyDir
-	root      string
-	maxAge    time.Duration
+	// cacheSize is the running total of bytes held in memory by the files
+	// the store created. It is accessed atomically, and is kept first so
+	// that it is aligned on 32 bit platforms.
+	cacheSize int64
+
+	files  map[string]Resource
+	dirs   map[string]Resource
+	root   string
+	maxAge time.Duration
+
+	// customs lists the registered resources that are not counted by
+	// cacheSize, and have to be asked for their size. It is rebuilt
+	// whenever a resource is registered or unregistered.
+	customs []Resource
+
+	// lock guards files, dirs, and customs, since resources can be
+	// registered, unregistered, and invalidated while requests are being
+	// handled.
+	lock sync.RWMutex
+
+	cacheLimit int64
+	usage      map[string]time.Time
+	usageLock  sync.Mutex
+}
+
+/* DirOption is an option that can be passed to RegisterDir.
+ */
+type DirOption int
+
+const (
+	// PreloadAll loads every file in the directory into memory in the
+	// background as soon as the directory is registered.
+	PreloadAll DirOption = iota + 1
+)
+
+/* preloadWorkers is the maximum amount of files that can be preloaded at once.
+ * Keeping this low prevents the cell from running out of file descriptors when
+ * preloading large directories.
+ */
+const preloadWorkers = 4
+
+/* preloadSlots is used as a semaphore to limit how many preloads run at once
+ * across the entire program.
+ */
+var preloadSlots = make(chan struct{}, preloadWorkers)
+
+/* preloadJob is a resource waiting to be preloaded.
+ */
+type preloadJob struct {
+	webPath   string
+	preloader Preloader
 }
 
 /* New creates a new Store.
@@ -32,10 +79,11 @@ func New(root string) (store *Store) {
 		root = root[:lastIndex]
 	}
 	return &Store{
-		lazyFiles: make(map[string]*LazyFile),
-		lazyDirs:  make(map[string]*LazyDir),
-		root:      root,
-		maxAge:    time.Hour * 4,
+		files:  make(map[string]Resource),
+		dirs:   make(map[string]Resource),
+		root:   root,
+		maxAge: time.Hour * 4,
+		usage:  make(map[string]time.Time),
 	}
 }
 
@@ -58,10 +106,11 @@ func (store *Store) RegisterFile(
 
 	filePath = store.root + filePath
 
-	store.lazyFiles[webPath] = &LazyFile{
+	store.setFile(webPath, &LazyFile{
 		FilePath:   filePath,
 		AutoReload: autoReload,
-	}
+		counter:    &store.cacheSize,
+	})
 
 	scribe.PrintInfo(
 		scribe.LogLevelDebug,
@@ -70,12 +119,14 @@ func (store *Store) RegisterFile(
 }
 
 /* RegisterDir registers a directory located at the directory path on the
- * specific url path.
+ * specific url path. If PreloadAll is passed as an option, the files in the
+ * directory are loaded into memory in the background.
  */
 func (store *Store) RegisterDir(
 	dirPath string,
 	webPath string,
 	active bool,
+	options ...DirOption,
 ) (
 	err error,
 ) {
@@ -95,28 +146,213 @@ func (store *Store) RegisterDir(
 
 	dirPath = store.root + dirPath
 
-	store.lazyDirs[webPath] = &LazyDir{
+	lazyDir := &LazyDir{
 		DirPath: dirPath,
 		WebPath: webPath,
 		Active:  active,
 		items:   make(map[string]*LazyFile),
+		counter: &store.cacheSize,
 	}
+	// list the directory before registering it, so that a directory which
+	// can't be read doesn't stay registered
+	var jobs []preloadJob
+	for _, option := range options {
+		switch option {
+		case PreloadAll:
+			jobs, err = lazyDir.preloadJobs()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	store.setDir(webPath, lazyDir)
 
 	scribe.PrintInfo(
 		scribe.LogLevelDebug,
 		"registered dir", dirPath, "on", webPath)
+	preloadInBackground(jobs, store)
+	return nil
+}
+
+/* RegisterResource registers a custom resource on the specific url path. The
+ * resource will only be sent for requests that match the path exactly.
+ */
+func (store *Store) RegisterResource(
+	webPath string,
+	resource Resource,
+) (
+	err error,
+) {
+	if webPath[0] != '/' {
+		webPath = "/" + webPath
+	}
+
+	store.setFile(webPath, resource)
+
+	scribe.PrintInfo(
+		scribe.LogLevelDebug,
+		"registered resource on", webPath)
 	return nil
 }
 
+/* RegisterDirResource registers a custom resource on the specific url path,
+ * treating it like a directory. The resource will be sent for requests for any
+ * path directly inside of the directory, and should return ErrNotFound if it
+ * has nothing to serve at the requested path.
+ */
+func (store *Store) RegisterDirResource(
+	webPath string,
+	resource Resource,
+) (
+	err error,
+) {
+	if webPath[0] != '/' {
+		webPath = "/" + webPath
+	}
+	if webPath[len(webPath)-1] != '/' {
+		webPath += "/"
+	}
+
+	store.setDir(webPath, resource)
+
+	scribe.PrintInfo(
+		scribe.LogLevelDebug,
+		"registered dir resource on", webPath)
+	return nil
+}
+
+/* Preload finds the files registered at the specified url paths, and loads
+ * them into memory in the background so that the first request for them
+ * doesn't have to wait for them to be read from disk. Paths can refer to
+ * registered files, files inside of registered directories, or registered
+ * directories themselves, in which case the whole directory is preloaded.
+ * Paths which don't match anything are skipped, as are resources which don't
+ * implement Preloader. Paths inside of custom directory resources are skipped
+ * too, since those can only be preloaded as a whole by passing the path of
+ * the directory.
+ */
+func (store *Store) Preload(webPaths ...string) {
+	jobs := []preloadJob{}
+	for _, webPath := range webPaths {
+		store.lock.RLock()
+		dir, isDirPath := store.dirs[webPath]
+		store.lock.RUnlock()
+		if isDirPath {
+			store.preloadDir(webPath, dir)
+			continue
+		}
+
+		resource, _, isDir, err := store.find(webPath)
+		if err != nil {
+			scribe.PrintError(
+				scribe.LogLevelError,
+				"can't preload", webPath+":", err)
+			continue
+		}
+		if resource == nil {
+			scribe.PrintWarning(
+				scribe.LogLevelNormal,
+				"can't preload", webPath+": not registered")
+			continue
+		}
+
+		preloader, ok := resource.(Preloader)
+		if !ok || isDir {
+			continue
+		}
+		jobs = append(jobs, preloadJob{webPath, preloader})
+	}
+	preloadInBackground(jobs, store)
+}
+
+/* preloadDir preloads an entire registered directory. LazyDirs load their file
+ * list right away and their files in the background, while custom directory
+ * resources are preloaded in the background if they implement Preloader.
+ */
+func (store *Store) preloadDir(webPath string, dir Resource) {
+	lazyDir, isLazyDir := dir.(*LazyDir)
+	if isLazyDir {
+		jobs, err := lazyDir.preloadJobs()
+		if err != nil {
+			scribe.PrintError(
+				scribe.LogLevelError,
+				"can't preload", webPath+":", err)
+			return
+		}
+		preloadInBackground(jobs, store)
+		return
+	}
+
+	preloader, ok := dir.(Preloader)
+	if ok {
+		preloadInBackground([]preloadJob{{webPath, preloader}}, store)
+	}
+}
+
+/* preloadInBackground preloads a list of resources in the background, running
+ * no more than preloadWorkers at a time. If store is not nil, its cache limit
+ * is checked before each resource is preloaded, and once it has been reached
+ * the rest of the list is skipped. Resources that were preloaded are recorded
+ * as used, so that they aren't the first to be thrown out when memory needs to
+ * be freed.
+ */
+func preloadInBackground(jobs []preloadJob, store *Store) {
+	if len(jobs) == 0 {
+		return
+	}
+
+	go func() {
+		for index, job := range jobs {
+			preloadSlots <- struct{}{}
+			if store != nil && store.cacheFull() {
+				<-preloadSlots
+				scribe.PrintWarning(
+					scribe.LogLevelNormal,
+					"cache limit reached, skipping",
+					len(jobs)-index, "preloads")
+				return
+			}
+
+			go func(job preloadJob) {
+				defer func() { <-preloadSlots }()
+				preloaded := preload(job.webPath, job.preloader)
+				if preloaded && store != nil {
+					store.markPreloaded(job.webPath)
+				}
+			}(job)
+		}
+	}()
+}
+
+/* preload preloads a resource, logging any error that occurs. It returns
+ * whether the resource was preloaded.
+ */
+func preload(webPath string, preloader Preloader) (preloaded bool) {
+	err := preloader.Preload()
+	if err != nil {
+		scribe.PrintError(
+			scribe.LogLevelError,
+			"can't preload", webPath+":", err)
+		return false
+	}
+	return true
+}
+
 /* UnregisterFile finds the file registered at the specified url path and
  * unregisters it, freeing it from memory
  */
 func (store *Store) UnregisterFile(webPath string) (err error) {
-	_, exists := store.lazyFiles[webPath]
+	store.lock.Lock()
+	resource, exists := store.files[webPath]
+	delete(store.files, webPath)
+	store.updateCustoms()
+	store.lock.Unlock()
 	if !exists {
 		return errors.New("path " + webPath + " is not registered")
 	}
-	delete(store.lazyFiles, webPath)
+	resource.Invalidate()
+	store.forgetUsage(webPath, false)
 
 	scribe.PrintInfo(
 		scribe.LogLevelDebug,
@@ -128,11 +364,16 @@ func (store *Store) UnregisterFile(webPath string) (err error) {
  * unregisters it, freeing it from memory
  */
 func (store *Store) UnregisterDir(webPath string) (err error) {
-	_, exists := store.lazyDirs[webPath]
+	store.lock.Lock()
+	resource, exists := store.dirs[webPath]
+	delete(store.dirs, webPath)
+	store.updateCustoms()
+	store.lock.Unlock()
 	if !exists {
 		return errors.New("path " + webPath + " is not registered")
 	}
-	delete(store.lazyDirs, webPath)
+	resource.Invalidate()
+	store.forgetUsage(webPath, true)
 
 	scribe.PrintInfo(
 		scribe.LogLevelDebug,
@@ -152,40 +393,184 @@ func (store *Store) TryHandle(
 	handled bool,
 	err error,
 ) {
-	// look in registered lazy files
+	resource, key, _, err := store.find(head.Path)
+	if err != nil {
+		return false, err
+	}
+	if resource == nil {
+		return false, nil
+	}
+
+	err = resource.Send(band, head, store.maxAge)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+
+	store.markUsed(key)
+	return true, err
+}
+
+/* Invalidate finds the resource registered at the specified url path, and
+ * discards any data it has cached so that it is loaded again the next time it
+ * is requested. If the path is a registered directory, the entire directory is
+ * invalidated. Files inside of directories registered with RegisterDir can be
+ * invalidated on their own. A path inside of a custom directory resource
+ * invalidates the entire resource, since the store has no way of reaching the
+ * data it holds for a single path.
+ */
+func (store *Store) Invalidate(webPath string) (err error) {
+	store.lock.RLock()
+	resource, exists := store.dirs[webPath]
+	store.lock.RUnlock()
+
+	if !exists {
+		resource, _, _, err = store.find(webPath)
+		if err != nil {
+			return err
+		}
+		exists = resource != nil
+	}
+	if !exists {
+		return errors.New("path " + webPath + " is not registered")
+	}
+
+	resource.Invalidate()
+	return nil
+}
+
+/* Size returns the amount of data, in bytes, that all registered resources
+ * currently hold in memory. Files are counted as they are loaded and
+ * invalidated, so only custom resources need to be asked for their size.
+ */
+func (store *Store) Size() (size int64) {
+	store.lock.RLock()
+	customs := store.customs
+	store.lock.RUnlock()
+
+	size = atomic.LoadInt64(&store.cacheSize)
+	for _, resource := range customs {
+		size += resource.Size()
+	}
+	return size
+}
+
+/* setFile registers a resource in the files map, invalidating whatever was
+ * registered there before so that its memory is freed and no longer counted.
+ */
+func (store *Store) setFile(webPath string, resource Resource) {
+	store.lock.Lock()
+	previous := store.files[webPath]
+	store.files[webPath] = resource
+	store.updateCustoms()
+	store.lock.Unlock()
+
+	if previous != nil {
+		previous.Invalidate()
+	}
+}
+
+/* setDir registers a resource in the dirs map, invalidating whatever was
+ * registered there before so that its memory is freed and no longer counted.
+ */
+func (store *Store) setDir(webPath string, resource Resource) {
+	store.lock.Lock()
+	previous := store.dirs[webPath]
+	store.dirs[webPath] = resource
+	store.updateCustoms()
+	store.lock.Unlock()
+
+	if previous != nil {
+		previous.Invalidate()
+	}
+}
+
+/* updateCustoms rebuilds the list of resources that are not counted by
+ * cacheSize. A new slice is made every time, so that Size can keep using the
+ * old one without holding the lock. The store must be locked while this is
+ * called.
+ */
+func (store *Store) updateCustoms() {
+	customs := []Resource{}
+	for _, resource := range store.files {
+		if !store.counts(resource) {
+			customs = append(customs, resource)
+		}
+	}
+	for _, resource := range store.dirs {
+		if !store.counts(resource) {
+			customs = append(customs, resource)
+		}
+	}
+	store.customs = customs
+}
+
+/* counts returns whether the size of a resource is already counted by
+ * cacheSize.
+ */
+func (store *Store) counts(resource Resource) (counted bool) {
+	switch resource := resource.(type) {
+	case *LazyFile:
+		return resource.counter == &store.cacheSize
+	case *LazyDir:
+		return resource.counter == &store.cacheSize
+	default:
+		return false
+	}
+}
+
+/* find looks for the resource matching webPath, first in the registered files,
+ * and then in the registered directories. Paths inside of a LazyDir are
+ * resolved to the LazyFile they refer to. Paths inside of a custom directory
+ * resource resolve to the directory itself, in which case isDir is true. key
+ * is the url path the returned resource is known by. If nothing matches, it
+ * returns nil.
+ */
+func (store *Store) find(
+	webPath string,
+) (
+	resource Resource,
+	key string,
+	isDir bool,
+	err error,
+) {
+	// look in registered files
 	scribe.PrintProgress(
 		scribe.LogLevelDebug,
-		"looking for match in files for", head.Path)
-	lazyFile, matched := store.lazyFiles[head.Path]
+		"looking for match in files for", webPath)
+	store.lock.RLock()
+	resource, matched := store.files[webPath]
+	store.lock.RUnlock()
 	if matched {
-		err = lazyFile.Send(band, head, store.maxAge)
-		return true, err
+		return resource, webPath, false, nil
 	}
 
-	// look in registered lazy dirs
+	// look in registered dirs
 	scribe.PrintProgress(
 		scribe.LogLevelDebug,
-		"looking for match in dirs for", head.Path)
+		"looking for match in dirs for", webPath)
 
-	parentDir := filepath.Dir(head.Path)
+	parentDir := filepath.Dir(webPath)
 	if parentDir[len(parentDir)-1] != '/' {
 		parentDir += "/"
 	}
-	lazyDir, matched := store.lazyDirs[parentDir]
+	store.lock.RLock()
+	resource, matched = store.dirs[parentDir]
+	store.lock.RUnlock()
+	if !matched {
+		return nil, "", false, nil
+	}
 
-	if matched {
-		lazyFile, err = lazyDir.Find(head.Path)
-		if err != nil {
-			return false, err
-		}
-		if lazyFile == nil {
-			return false, nil
-		}
+	lazyDir, isLazyDir := resource.(*LazyDir)
+	if !isLazyDir {
+		return resource, parentDir, true, nil
+	}
 
-		err = lazyFile.Send(band, head, store.maxAge)
-		return true, err
+	lazyFile, err := lazyDir.Find(webPath)
+	if lazyFile == nil {
+		// avoid returning a nil *LazyFile as a non-nil Resource
+		return nil, "", false, err
 	}
-	return false, nil
+	return lazyFile, webPath, false, err
 }
 
 /* Returns the root path of the store. This can be helpful for doing things such
@@ -0,0 +1,230 @@
+package cell
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* queueHeader is the name of the request header that the queen (or any proxy
+ * in front of it) may set to the time at which it received the request. Two
+ * formats are understood, both optionally prefixed with "t=": an integer time
+ * since the epoch in seconds, milliseconds, microseconds, or nanoseconds, with
+ * the unit guessed from its magnitude, and a number of seconds since the epoch
+ * with a fractional part, as nginx produces with "t=${msec}".
+ */
+const queueHeader = "X-Request-Start"
+
+/* maxQueueSkew is how far the time reported in the queue header may be from the
+ * time the cell received the request before it is considered bogus. Anything
+ * further off is more likely to be a misconfigured proxy than a real delay.
+ */
+const maxQueueSkew = time.Hour
+
+/* timeoutHeader is the name of the request header that the queen (or any proxy
+ * in front of it) may set to the number of milliseconds the client is willing
+ * to wait for a response. It is relative rather than an absolute time, so that
+ * clock differences between machines don't affect it.
+ */
+const timeoutHeader = "X-Request-Timeout"
+
+/* Timing stores a breakdown of how long the different stages of serving an
+ * HTTP request took. It can be used to figure out whether latency is coming
+ * from the cell, the queen, or the network. Fields that are not known yet are
+ * left as their zero value.
+ */
+type Timing struct {
+	// Forwarded is when the queen received the request, if it told us.
+	// This comes from the queen's clock.
+	Forwarded time.Time
+	// Received is when the request arrived at the cell.
+	Received time.Time
+	// HandlerStart is when the OnHTTP handler was called.
+	HandlerStart time.Time
+	// FirstByte is when the response head was written.
+	FirstByte time.Time
+	// End is when the request finished being handled.
+	End time.Time
+	// Deadline is when the response should be finished by, if the queen
+	// told us.
+	Deadline time.Time
+}
+
+/* newTiming creates a new Timing, marking the request as received now. If the
+ * headers contain information about when the queen got the request, or how
+ * long the client will wait for it, that is recorded as well.
+ */
+func newTiming(headers map[string][]string) (timing *Timing) {
+	timing = &Timing{Received: time.Now()}
+
+	forwarded, ok := parseRequestStart(getHeader(headers, queueHeader))
+	skew := timing.Received.Sub(forwarded)
+	if ok && skew < maxQueueSkew && skew > -maxQueueSkew {
+		timing.Forwarded = forwarded
+	}
+
+	timeout, err := strconv.ParseInt(
+		strings.TrimSpace(getHeader(headers, timeoutHeader)), 10, 64)
+	if err == nil && timeout > 0 {
+		timing.Deadline = timing.Received.Add(
+			time.Duration(timeout) * time.Millisecond)
+	}
+	return
+}
+
+/* parseRequestStart parses the value of the queue header. It returns false if
+ * the value is missing or in a format it doesn't understand.
+ */
+func parseRequestStart(value string) (start time.Time, ok bool) {
+	value = strings.TrimPrefix(strings.TrimSpace(value), "t=")
+	if value == "" {
+		return time.Time{}, false
+	}
+
+	if strings.Contains(value, ".") {
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil || seconds <= 0 {
+			return time.Time{}, false
+		}
+		return time.UnixMicro(int64(seconds * 1e6)), true
+	}
+
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || number <= 0 {
+		return time.Time{}, false
+	}
+
+	// present day timestamps are around 1e9 in seconds, 1e12 in
+	// milliseconds, 1e15 in microseconds, and 1e18 in nanoseconds, so the
+	// unit can be told apart by the magnitude alone
+	switch {
+	case number < 1e11:
+		return time.Unix(number, 0), true
+	case number < 1e14:
+		return time.UnixMilli(number), true
+	case number < 1e17:
+		return time.UnixMicro(number), true
+	default:
+		return time.Unix(0, number), true
+	}
+}
+
+/* Queued returns how long the request spent between being received by the
+ * queen and arriving at the cell. This includes the network. If the queen did
+ * not report when it received the request, or if the difference between the
+ * queen's clock and the cell's makes the result negative, this returns zero.
+ */
+func (timing *Timing) Queued() (duration time.Duration) {
+	if timing.Forwarded.IsZero() {
+		return 0
+	}
+	duration = timing.Received.Sub(timing.Forwarded)
+	if duration < 0 {
+		return 0
+	}
+	return duration
+}
+
+/* TimeToFirstByte returns how long it took from the request arriving at the
+ * cell until the response head was written. If nothing has been written yet,
+ * this returns zero.
+ */
+func (timing *Timing) TimeToFirstByte() (duration time.Duration) {
+	if timing.FirstByte.IsZero() {
+		return 0
+	}
+	return timing.FirstByte.Sub(timing.Received)
+}
+
+/* Total returns how long the cell spent on the request in total. If the
+ * request has not finished yet, this returns the time elapsed so far.
+ */
+func (timing *Timing) Total() (duration time.Duration) {
+	if timing.End.IsZero() {
+		return time.Since(timing.Received)
+	}
+	return timing.End.Sub(timing.Received)
+}
+
+/* Remaining returns how much time is left until the deadline. If the queen did
+ * not send a deadline, ok is false. If the deadline has passed, the returned
+ * duration is negative.
+ */
+func (timing *Timing) Remaining() (remaining time.Duration, ok bool) {
+	if timing.Deadline.IsZero() {
+		return 0, false
+	}
+	return time.Until(timing.Deadline), true
+}
+
+/* Expired returns true if there is a deadline and it has passed. Handlers can
+ * check this before doing expensive work for a client that has given up.
+ */
+func (timing *Timing) Expired() (expired bool) {
+	remaining, ok := timing.Remaining()
+	return ok && remaining <= 0
+}
+
+/* serverTiming formats the timing information known so far as the value of a
+ * Server-Timing header. Since headers are written before the body, this can
+ * only include time spent up until now. The queue metric is left out if it is
+ * unknown or unreliable.
+ */
+func (timing *Timing) serverTiming() (value string) {
+	metrics := []string{}
+	if timing.Queued() > 0 {
+		metrics = append(
+			metrics, formatMetric("queue", timing.Queued()))
+	}
+	metrics = append(
+		metrics,
+		formatMetric("cell", time.Since(timing.Received)))
+	return strings.Join(metrics, ", ")
+}
+
+/* onWriteHead returns a function to be called by the band whenever a response
+ * head is written. It records when the first byte was written, and adds a
+ * Server-Timing header if serverTiming is true. Since it works at the band
+ * level, this applies to files served by the store as well.
+ */
+func (timing *Timing) onWriteHead(
+	serverTiming bool,
+) func(headers map[string][]string) map[string][]string {
+	return func(headers map[string][]string) map[string][]string {
+		if timing.FirstByte.IsZero() {
+			timing.FirstByte = time.Now()
+		}
+		if !serverTiming {
+			return headers
+		}
+
+		// copy the headers so that maps shared between responses
+		// aren't modified
+		withTiming := make(map[string][]string, len(headers)+1)
+		for key, values := range headers {
+			withTiming[key] = values
+		}
+		withTiming["server-timing"] = []string{timing.serverTiming()}
+		return withTiming
+	}
+}
+
+/* formatMetric formats a single Server-Timing metric, with its duration in
+ * milliseconds.
+ */
+func formatMetric(name string, duration time.Duration) (metric string) {
+	milliseconds := float64(duration) / float64(time.Millisecond)
+	return name + ";dur=" + strconv.FormatFloat(milliseconds, 'f', 3, 64)
+}
+
+/* getHeader returns the first value of a header, ignoring case. If the header
+ * isn't present, it returns an empty string.
+ */
+func getHeader(headers map[string][]string, name string) (value string) {
+	for key, values := range headers {
+		if strings.EqualFold(key, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,106 @@
+package validate
+
+import (
+	"encoding/json"
+	"github.com/hlhv/cell"
+	"strings"
+)
+
+/* ErrorKind specifies what part of a request failed validation.
+ */
+type ErrorKind int
+
+const (
+	// ErrorKindQuery means a required query parameter was missing.
+	ErrorKindQuery ErrorKind = iota
+	// ErrorKindHeader means a required header was missing.
+	ErrorKindHeader
+	// ErrorKindContentType means the content type was not allowed.
+	ErrorKindContentType
+	// ErrorKindBody means the body could not be read or decoded.
+	ErrorKindBody
+	// ErrorKindField means a required body field was missing.
+	ErrorKindField
+)
+
+/* String returns a short name for the error kind, which is used when
+ * responding with a list of errors.
+ */
+func (kind ErrorKind) String() (name string) {
+	switch kind {
+	case ErrorKindQuery:
+		return "query"
+	case ErrorKindHeader:
+		return "header"
+	case ErrorKindContentType:
+		return "contentType"
+	case ErrorKindBody:
+		return "body"
+	case ErrorKindField:
+		return "field"
+	default:
+		return "unknown"
+	}
+}
+
+/* Error describes a single problem with a request. Name is the name of the
+ * query parameter, header, or body field that caused the problem, if there is
+ * one.
+ */
+type Error struct {
+	Kind    ErrorKind
+	Name    string
+	Message string
+}
+
+/* Error returns the message describing the problem.
+ */
+func (err *Error) Error() (message string) {
+	return err.Message
+}
+
+/* Errors is a list of problems found while validating a request.
+ */
+type Errors []*Error
+
+/* Error joins the messages of every error in the list.
+ */
+func (errs Errors) Error() (message string) {
+	messages := make([]string, len(errs))
+	for index, err := range errs {
+		messages[index] = err.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+/* Respond writes a 400 response containing the list of errors as JSON.
+ */
+func (errs Errors) Respond(response *cell.HTTPResponse) (err error) {
+	type errorJSON struct {
+		Kind    string `json:"kind"`
+		Name    string `json:"name,omitempty"`
+		Message string `json:"message"`
+	}
+
+	list := make([]errorJSON, len(errs))
+	for index, item := range errs {
+		list[index] = errorJSON{
+			Kind:    item.Kind.String(),
+			Name:    item.Name,
+			Message: item.Message,
+		}
+	}
+
+	body, err := json.Marshal(map[string][]errorJSON{"errors": list})
+	if err != nil {
+		return err
+	}
+
+	err = response.WriteHead(400, map[string][]string{
+		"content-type": {"application/json"},
+	})
+	if err != nil {
+		return err
+	}
+	return response.WriteBody(body)
+}
@@ -0,0 +1,290 @@
+package validate
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hlhv/cell"
+	"github.com/hlhv/scribe"
+	"mime"
+	"reflect"
+	"strings"
+)
+
+/* Validator describes what a valid HTTP request looks like. Expectations are
+ * added to it by chaining its methods, and requests can then be checked
+ * against it. A Validator can be created once and used for every request that
+ * a handler receives, even concurrently.
+ */
+type Validator struct {
+	queries      []string
+	headers      []string
+	contentTypes []string
+}
+
+/* New creates a new Validator with no expectations. An example of how it might
+ * be used:
+ *
+ * var createValidator = validate.New().
+ *         Query("id").
+ *         ContentType("application/json")
+ *
+ * func onCreate(response *cell.HTTPResponse, request *cell.HTTPRequest) {
+ *         payload := &struct {
+ *                 Name string `json:"name" validate:"required"`
+ *         }{}
+ *         if !createValidator.CheckAndRespond(response, request, payload) {
+ *                 return
+ *         }
+ *         ...
+ * }
+ */
+func New() (validator *Validator) {
+	return &Validator{}
+}
+
+/* Query requires that the specified query parameters are present in the
+ * request and not empty.
+ */
+func (validator *Validator) Query(names ...string) (self *Validator) {
+	validator.queries = append(validator.queries, names...)
+	return validator
+}
+
+/* Header requires that the specified headers are present in the request and
+ * not empty. Header names are not case sensitive.
+ */
+func (validator *Validator) Header(names ...string) (self *Validator) {
+	validator.headers = append(validator.headers, names...)
+	return validator
+}
+
+/* ContentType requires that the content type of the request matches one of the
+ * specified types. Parameters such as charset are ignored when comparing.
+ */
+func (validator *Validator) ContentType(
+	types ...string,
+) (
+	self *Validator,
+) {
+	validator.contentTypes = append(validator.contentTypes, types...)
+	return validator
+}
+
+/* Check checks the request against the validator, and returns a list of every
+ * problem it found. If the request is valid, it returns nil.
+ *
+ * If target is not nil, the request body must be valid JSON, and it is decoded
+ * into target, which must be a non-nil pointer to a struct. Fields of the
+ * struct that have the tag validate:"required" must be present in the body.
+ * Only top level fields are checked. Passing any other kind of target is a
+ * mistake in the handler rather than in the request, so it causes a panic.
+ */
+func (validator *Validator) Check(
+	request *cell.HTTPRequest,
+	target interface{},
+) (
+	errs Errors,
+) {
+	if target != nil {
+		checkTarget(target)
+	}
+
+	for _, name := range validator.queries {
+		values := request.Head.Query[name]
+		if len(values) == 0 || values[0] == "" {
+			errs = append(errs, &Error{
+				Kind:    ErrorKindQuery,
+				Name:    name,
+				Message: "missing query parameter " + name,
+			})
+		}
+	}
+
+	for _, name := range validator.headers {
+		if request.GetHeader(name) == "" {
+			errs = append(errs, &Error{
+				Kind:    ErrorKindHeader,
+				Name:    name,
+				Message: "missing header " + name,
+			})
+		}
+	}
+
+	if len(validator.contentTypes) > 0 {
+		err := validator.checkContentType(request)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// there is no point in reading the body if the request is already
+	// known to be invalid
+	if target != nil && errs == nil {
+		errs = append(errs, checkBody(request, target)...)
+	}
+
+	return errs
+}
+
+/* CheckAndRespond checks the request against the validator, as Check does. If
+ * the request is invalid, it responds with a 400 status code and a list of the
+ * problems it found, and returns false. The handler should return without
+ * writing anything else if this happens.
+ */
+func (validator *Validator) CheckAndRespond(
+	response *cell.HTTPResponse,
+	request *cell.HTTPRequest,
+	target interface{},
+) (
+	valid bool,
+) {
+	errs := validator.Check(request, target)
+	if errs == nil {
+		return true
+	}
+
+	err := errs.Respond(response)
+	if err != nil {
+		scribe.PrintError(
+			scribe.LogLevelError,
+			"could not respond with validation errors:", err)
+	}
+	return false
+}
+
+/* checkContentType checks that the content type of the request is one of the
+ * allowed types.
+ */
+func (validator *Validator) checkContentType(
+	request *cell.HTTPRequest,
+) (
+	err *Error,
+) {
+	contentType := request.GetHeader("content-type")
+	mediaType, _, parseErr := mime.ParseMediaType(contentType)
+	if parseErr == nil {
+		for _, allowed := range validator.contentTypes {
+			if strings.EqualFold(mediaType, allowed) {
+				return nil
+			}
+		}
+	}
+
+	return &Error{
+		Kind: ErrorKindContentType,
+		Name: "content-type",
+		Message: "content type must be one of: " +
+			strings.Join(validator.contentTypes, ", "),
+	}
+}
+
+/* checkTarget panics if target is not a non-nil pointer to a struct.
+ */
+func checkTarget(target interface{}) {
+	value := reflect.ValueOf(target)
+	if value.Kind() != reflect.Ptr || value.IsNil() {
+		panic(fmt.Sprintf(
+			"validate: target must be a non-nil pointer, got %T",
+			target))
+	}
+	if value.Elem().Kind() != reflect.Struct {
+		panic(fmt.Sprintf(
+			"validate: target must point to a struct, got %T",
+			target))
+	}
+}
+
+/* checkBody reads the request body, decodes it into the target, and makes sure
+ * all required fields were present.
+ */
+func checkBody(
+	request *cell.HTTPRequest,
+	target interface{},
+) (
+	errs Errors,
+) {
+	data, err := request.ReadBodyFull()
+	if err != nil {
+		return Errors{{
+			Kind:    ErrorKindBody,
+			Message: "could not read body: " + err.Error(),
+		}}
+	}
+
+	err = json.Unmarshal(data, target)
+	if err != nil {
+		return Errors{{
+			Kind:    ErrorKindBody,
+			Message: "invalid JSON: " + err.Error(),
+		}}
+	}
+
+	// unmarshal again to find out which fields were actually present,
+	// since a zero value in the target could mean either
+	present := map[string]json.RawMessage{}
+	err = json.Unmarshal(data, &present)
+	if err != nil {
+		return Errors{{
+			Kind:    ErrorKindBody,
+			Message: "body must be a JSON object",
+		}}
+	}
+
+	for _, name := range requiredFields(target) {
+		if !hasKey(present, name) {
+			errs = append(errs, &Error{
+				Kind:    ErrorKindField,
+				Name:    name,
+				Message: "missing field " + name,
+			})
+		}
+	}
+
+	return errs
+}
+
+/* requiredFields returns the JSON names of the fields in a struct that are
+ * tagged with validate:"required".
+ */
+func requiredFields(target interface{}) (names []string) {
+	kind := reflect.TypeOf(target)
+	for kind.Kind() == reflect.Ptr {
+		kind = kind.Elem()
+	}
+	if kind.Kind() != reflect.Struct {
+		return nil
+	}
+
+	for index := 0; index < kind.NumField(); index++ {
+		field := kind.Field(index)
+		if field.Tag.Get("validate") != "required" {
+			continue
+		}
+
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+/* hasKey checks if a key is present in a decoded JSON object. Like the json
+ * package, it prefers an exact match but will fall back to ignoring case.
+ */
+func hasKey(object map[string]json.RawMessage, name string) (exists bool) {
+	_, exists = object[name]
+	if exists {
+		return true
+	}
+	for key := range object {
+		if strings.EqualFold(key, name) {
+			return true
+		}
+	}
+	return false
+}